@@ -0,0 +1,89 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grahamking/latency/probe"
+)
+
+// New columns go at the end, for anything reading the older ones by position
+var csvHeader = []string{"host", "addr", "port", "latency_ms", "timed_out", "timestamp", "state", "resolve_ms"}
+
+// Writes one row per probe, for -csv. Targets are probed concurrently with
+// -a and -f, so rows are written under a lock.
+// A nil *csvWriter is valid and writes nothing.
+type csvWriter struct {
+	mu sync.Mutex
+	w  *csv.Writer
+}
+
+func newCSVWriter(out io.Writer) *csvWriter {
+	c := &csvWriter{w: csv.NewWriter(out)}
+	c.write(csvHeader)
+	return c
+}
+
+// latency_ms and state (open or closed) are empty for a probe that got no
+// reply, and state is with -icmp too. resolve_ms is the same on every row for
+// a host, which was only resolved once. There is no column for errors other
+// than a timeout, so those go to stderr, which keeps stdout a valid CSV file.
+func (c *csvWriter) row(r resolution, port uint16, sent time.Time, reply probe.Reply, err error) {
+	if c == nil {
+		return
+	}
+	timedOut := errors.Is(err, probe.ErrTimeout)
+	latency, state := "", ""
+	if err == nil {
+		latency = strconv.FormatFloat(ms(reply.RTT), 'f', 3, 64)
+		if !*icmpParam {
+			state = portState(reply.Open)
+		}
+	} else if !timedOut {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", r.host, err)
+	}
+	c.write([]string{
+		r.host,
+		r.addr,
+		strconv.Itoa(int(port)),
+		latency,
+		strconv.FormatBool(timedOut),
+		sent.Format(time.RFC3339Nano),
+		state,
+		strconv.FormatFloat(ms(r.took), 'f', 3, 64),
+	})
+}
+
+// Flushed every row, so that rows from a long -t run arrive as they happen
+func (c *csvWriter) write(record []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.Write(record)
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		log.Println("csv:", err)
+	}
+}
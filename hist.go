@@ -0,0 +1,111 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Widest bar in the histogram, in characters
+const histWidth = 40
+
+// Most rows in the histogram. Buckets are 1ms wide unless that would make
+// more rows than this, then they are widened to a whole number of ms.
+const histMaxBuckets = 20
+
+// The p'th percentile (0-100) of samples, by nearest rank
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// The tail that min/avg/max hides: p50/p90/p95/p99 = 1.200/1.900/2.300/8.100 ms
+func (s Stats) Percentiles() string {
+	return fmt.Sprintf("p50/p90/p95/p99 = %.3f/%.3f/%.3f/%.3f ms",
+		ms(percentile(s.Samples, 50)), ms(percentile(s.Samples, 90)),
+		ms(percentile(s.Samples, 95)), ms(percentile(s.Samples, 99)))
+}
+
+// One row per millisecond range from the fastest sample to the slowest:
+//
+//	12 -   13 ms | ######################################## 81
+//	13 -   14 ms | ######                                   12
+func histogram(samples []time.Duration) string {
+	if len(samples) == 0 {
+		return ""
+	}
+	low, high := samples[0], samples[0]
+	for _, sample := range samples {
+		if sample < low {
+			low = sample
+		}
+		if sample > high {
+			high = sample
+		}
+	}
+
+	first := int(ms(low))
+	span := int(ms(high)) - first + 1
+	width := (span + histMaxBuckets - 1) / histMaxBuckets
+	counts := make([]int, (span+width-1)/width)
+	for _, sample := range samples {
+		counts[(int(ms(sample))-first)/width]++
+	}
+
+	most := 0
+	for _, count := range counts {
+		if count > most {
+			most = count
+		}
+	}
+
+	var b strings.Builder
+	for i, count := range counts {
+		from := first + i*width
+		bar := strings.Repeat("#", (count*histWidth+most-1)/most)
+		fmt.Fprintf(&b, "%4d - %4d ms | %-*s %d\n", from, from+width, histWidth, bar, count)
+	}
+	return b.String()
+}
+
+// Printed under the min/avg/max line when there is more than one sample
+func printDistribution(stats Stats) {
+	if stats.Received < 2 {
+		return
+	}
+	fmt.Println(stats.Percentiles())
+	if *histParam {
+		fmt.Print(histogram(stats.Samples))
+	}
+}
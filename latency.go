@@ -17,23 +17,56 @@ For full license details see <http://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"os"
-	"strconv"
+	"os/signal"
+	"sort"
 	"strings"
-	"sync"
 	"time"
+
+	"github.com/grahamking/latency/probe"
 )
 
 var (
 	ifaceParam   = flag.String("i", "", "Interface (e.g. eth0, wlan1, etc)")
 	helpParam    = flag.Bool("h", false, "Print help")
-	portParam    = flag.Int("p", 80, "Port to test against (default 80)")
+	portParam    = flag.String("p", "80", "Port, or list of ports and ranges, to test against (default 80)")
+	srcPortParam = flag.Int("sp", 0, "Source port to send from, 0 for random")
+	countParam   = flag.Int("c", 1, "Number of probes to send")
+	foreverParam = flag.Bool("t", false, "Keep probing until interrupted")
+	delayParam   = flag.Duration("I", time.Second, "Time between probes with -c or -t")
+	waitParam    = flag.Duration("w", probe.DefaultTimeout, "How long to wait for each reply")
+	retriesParam = flag.Int("r", 0, "Retransmit the SYN up to this many times if there's no reply")
+	warmupParam  = flag.Int("warmup", 0, "Send this many probes first and leave them out of the stats")
+	maxParam     = flag.Duration("max", 0, "Exit 2 if the average RTT is over this")
+	maxLossParam = flag.Float64("maxloss", 100, "Exit 3 if more than this percentage of probes are lost")
 	autoParam    = flag.Bool("a", false, "Measure latency to several well known addresses")
+	allParam     = flag.Bool("all", false, "Measure every address the host resolves to")
+	fileParam    = flag.String("f", "", "Measure the hosts listed in this file, one host or host:port per line")
+	ipv6Param    = flag.Bool("6", false, "Use IPv6")
+	jsonParam    = flag.Bool("json", false, "Print results as JSON")
+	csvParam     = flag.Bool("csv", false, "Print one CSV row per probe")
+	histParam    = flag.Bool("hist", false, "Print a histogram of the RTTs with -c or -t")
+	verboseParam = flag.Bool("v", false, "Dump the SYN and every packet received, and why any were skipped")
+	dnsParam     = flag.Duration("dns-timeout", 3*time.Second, "Give up resolving the remote host after this long")
+	kstatsParam  = flag.Bool("kstats", false, "Show kernel neighbor and TCP stats around each probe (Linux only)")
+	retransParam = flag.Duration("synack-window", 0, "After the first SYN-ACK, keep listening this long for retransmits")
+	statsdParam  = flag.String("statsd", "", "Send RTTs to this StatsD server (host:port)")
+	listenParam  = flag.String("listen", "", "Keep probing and serve Prometheus metrics on this address (e.g. :9101)")
+	busyParam    = flag.Bool("busy-poll", false, "Spin on a non-blocking socket while waiting for the reply (Linux only)")
+	arpParam     = flag.Bool("include-arp", false, "Resolve and time the next hop's ARP entry before probing (Linux only)")
+	ttlParam     = flag.Int("ttl", 0, "IP TTL (IPv6 hop limit) of the SYN (default system's)")
+	icmpParam    = flag.Bool("icmp", false, "Time an ICMP echo instead of a TCP SYN")
+	connectParam = flag.Bool("connect", false, "Time a normal TCP connect, which doesn't need root")
+	winParam     = flag.Int("win", 0, "The SYN's window size (default 0xaaaa)")
+	mssParam     = flag.Int("mss", 0, "Add an MSS option with this size to the SYN, e.g. 1460")
+	statsdSink   *statsd
+	csvSink      *csvWriter
 	defaultHosts = map[string]string{
 		// Busiest sites on the Internet, according to Wolfram Alpha
 		"Google":   "google.com",
@@ -62,7 +95,12 @@ func main() {
 
 	iface := *ifaceParam
 	if iface == "" {
-		iface = chooseInterface()
+		var err error
+		iface, err = chooseInterface()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		if iface == "" {
 			fmt.Println("Could not decide which net interface to use.")
 			fmt.Println("Specify it with -i <iface> param")
@@ -70,12 +108,143 @@ func main() {
 		}
 	}
 
-	localAddr := interfaceAddress(iface)
-	laddr := strings.Split(localAddr.String(), "/")[0] // Clean addresses like 192.168.1.30/24
+	// An address literal decides the family, otherwise it's -6
+	remoteHost := flag.Arg(0)
+	useIPv6, linkLocal := *ipv6Param, false
+	if ip := net.ParseIP(stripZone(remoteHost)); ip != nil && !*autoParam {
+		useIPv6 = ip.To4() == nil
+		linkLocal = ip.IsLinkLocalUnicast()
+	}
+	laddr, err := interfaceAddress(iface, useIPv6, linkLocal)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// The kernel can't route to fe80::1 without knowing which link it's on.
+	// That's the -i interface, the zone our address has too.
+	if useIPv6 && linkLocal && !strings.Contains(remoteHost, "%") {
+		if *ifaceParam == "" {
+			fmt.Printf("A link-local address needs a zone, e.g. fe80::1%%eth0, or the interface with -i\n")
+			os.Exit(1)
+		}
+		remoteHost += "%" + iface
+	}
 
-	port := uint16(*portParam)
+	if *connectParam && *icmpParam {
+		fmt.Println("Use one of -connect and -icmp, not both")
+		os.Exit(1)
+	}
+	if !*connectParam {
+		err := probe.CheckRawSocket(laddr)
+		if errors.Is(err, os.ErrPermission) && !*icmpParam {
+			fmt.Fprintln(os.Stderr, "Warning: raw sockets aren't permitted, so timing a TCP connect instead (-connect). Run as root for the raw SYN timing.")
+			if *ifaceParam != "" {
+				fmt.Fprintln(os.Stderr, "Warning: -i may not work without root either, as older kernels need CAP_NET_RAW to bind a socket to an interface.")
+			}
+			*connectParam = true
+		} else if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *busyParam && !probe.BusyPollSupported {
+		fmt.Println("-busy-poll is only supported on Linux")
+		os.Exit(1)
+	}
+
+	if *statsdParam != "" {
+		if statsdSink, err = newStatsd(*statsdParam); err != nil {
+			fmt.Println("StatsD:", err)
+			os.Exit(1)
+		}
+		defer statsdSink.flush()
+	}
+
+	if *jsonParam && *csvParam {
+		fmt.Println("Use one of -json and -csv, not both")
+		os.Exit(1)
+	}
+	if *csvParam {
+		csvSink = newCSVWriter(os.Stdout)
+	}
+
+	if *countParam < 1 {
+		fmt.Println("-c must be at least 1")
+		os.Exit(1)
+	}
+	if *srcPortParam < 0 || *srcPortParam > 65535 {
+		fmt.Println("-sp must be between 1 and 65535, or 0 for random")
+		os.Exit(1)
+	}
+	if *connectParam && *srcPortParam != 0 {
+		// The port of each connection stays in TIME_WAIT after it's closed
+		fmt.Println("-sp can't be used with -connect, as each connect needs a new source port")
+		os.Exit(1)
+	}
+	if (*connectParam || *icmpParam) && *retransParam > 0 {
+		fmt.Println("-synack-window can't be used with -connect or -icmp, which never see a SYN-ACK retransmitted")
+		os.Exit(1)
+	}
+	if *delayParam < 0 {
+		fmt.Println("-I can't be negative")
+		os.Exit(1)
+	}
+	if *ttlParam < 0 || *ttlParam > 255 {
+		fmt.Println("-ttl must be between 1 and 255, or 0 for the system's default")
+		os.Exit(1)
+	}
+	if *retriesParam < 0 {
+		fmt.Println("-r can't be negative")
+		os.Exit(1)
+	}
+	if *winParam < 0 || *winParam > 65535 {
+		fmt.Println("-win must be between 1 and 65535, or 0 for the default")
+		os.Exit(1)
+	}
+	if *mssParam < 0 || *mssParam > 65535 {
+		fmt.Println("-mss must be between 1 and 65535, or 0 for no MSS option")
+		os.Exit(1)
+	}
+	if *maxParam < 0 {
+		fmt.Println("-max can't be negative")
+		os.Exit(1)
+	}
+	if *maxLossParam < 0 {
+		fmt.Println("-maxloss can't be negative")
+		os.Exit(1)
+	}
+	if *warmupParam < 0 {
+		fmt.Println("-warmup can't be negative")
+		os.Exit(1)
+	}
+
+	ports, err := parsePorts(*portParam)
+	if err != nil {
+		fmt.Println("-p:", err)
+		os.Exit(1)
+	}
+	if len(ports) > 1 && (*icmpParam || *foreverParam || *allParam || manyTargets() || *listenParam != "") {
+		fmt.Println("A list of ports can't be used with -a, -f, -all, -t, -listen or -icmp")
+		os.Exit(1)
+	}
+	port := ports[0]
+	if *listenParam != "" {
+		targets, err := listenTargets(remoteHost, port)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(serveMetrics(laddr, *listenParam, targets))
+		os.Exit(1)
+	}
 	if *autoParam {
-		autoTest(laddr, port)
+		autoTest(laddr, port, *countParam)
+		return
+	}
+	if *fileParam != "" {
+		fileTest(laddr, *fileParam, port, *countParam)
 		return
 	}
 
@@ -85,173 +254,683 @@ func main() {
 		os.Exit(1)
 	}
 
-	remoteHost := flag.Arg(0)
-	fmt.Println("Measuring round-trip latency from", laddr, "to", remoteHost, "on port", port)
-	fmt.Printf("Latency: %v\n", latency(laddr, remoteHost, port))
+	if len(ports) > 1 {
+		measurePorts(laddr, remoteHost, ports, *countParam)
+		return
+	}
+	if *foreverParam {
+		if textOutput() {
+			fmt.Println("Measuring round-trip latency from", laddr, "to", remoteHost, via(port))
+		}
+		watch(laddr, remoteHost, port)
+		return
+	}
+	if *allParam {
+		measureAll(laddr, remoteHost, port, *countParam)
+		return
+	}
+	var limits thresholds
+	if *jsonParam {
+		stats, err := measure(laddr, remoteHost, port, *countParam)
+		printJSON(newResult(remoteHost, port, stats, err))
+		limits.check(remoteHost, stats, err)
+		limits.exit()
+		return
+	}
+	if *csvParam {
+		// The rows are written as the probes are sent
+		stats, err := measure(laddr, remoteHost, port, *countParam)
+		limits.check(remoteHost, stats, err)
+		limits.exit()
+		return
+	}
+
+	fmt.Println("Measuring round-trip latency from", laddr, "to", remoteHost, via(port))
+	stats, err := measure(laddr, remoteHost, port, *countParam)
+	if err == probe.ErrTimeout {
+		if *retriesParam > 0 {
+			fmt.Printf("Latency: timed out, 100%% lost after %d retransmits\n", *retriesParam)
+		} else {
+			fmt.Println("Latency: timed out")
+		}
+	} else if err != nil {
+		fmt.Println(err)
+	} else if *countParam == 1 {
+		fmt.Printf("Latency: %v%s%s\n", stats.Mean, ttlNote(stats.TTL), stateNote(stats.Open))
+	} else {
+		fmt.Printf("%d probes sent, %d received, %.0f%% loss\n", stats.Sent, stats.Received, stats.Loss()*100)
+		fmt.Println(stats)
+		printDistribution(stats)
+	}
+	limits.check(remoteHost, stats, err)
+	limits.exit()
+}
+
+// Sends any batched StatsD metrics first, as os.Exit skips deferred calls
+func exit(status int) {
+	statsdSink.flush()
+	os.Exit(status)
 }
 
-func autoTest(localAddr string, port uint16) {
+// Probes all the hosts at once, then prints them fastest first, with the
+// failures at the end. With a count above 1 this shows the average for
+// each host. With -json it prints a single array of all the results.
+func autoTest(localAddr string, port uint16, count int) {
+	var targets []target
 	for name, host := range defaultHosts {
-		fmt.Printf("%15s: %v\n", name, latency(localAddr, host, port))
+		targets = append(targets, target{name, host, port})
 	}
+
+	results := measureTargets(localAddr, targets, count)
+	sort.Slice(results, func(i, j int) bool {
+		if (results[i].err == nil) != (results[j].err == nil) {
+			return results[i].err == nil
+		}
+		return results[i].stats.Mean < results[j].stats.Mean
+	})
+
+	defer checkResults(results)
+	if *csvParam {
+		return
+	}
+	if *jsonParam {
+		printResultsJSON(results)
+		return
+	}
+	for _, result := range results {
+		if result.err != nil {
+			fmt.Printf("%15s: %s\n", result.name, result.err)
+			continue
+		}
+		fmt.Printf("%15s: %v\n", result.name, result.stats.Mean)
+	}
+}
+
+// How the "Measuring round-trip latency" line ends
+func via(port uint16) string {
+	if *icmpParam {
+		return "with ICMP echo"
+	}
+	if *connectParam {
+		return fmt.Sprintf("on port %d with TCP connect", port)
+	}
+	return fmt.Sprintf("on port %d", port)
+}
+
+// -json and -csv replace all the normal output
+func textOutput() bool {
+	return !*jsonParam && !*csvParam
 }
 
-func latency(localAddr string, remoteHost string, port uint16) time.Duration {
-	var wg sync.WaitGroup
-	wg.Add(1)
-	var receiveTime time.Time
+// Whether measure is one of many, so shouldn't print per probe
+func manyTargets() bool {
+	return *autoParam || *allParam || *fileParam != ""
+}
+
+func replyNote(reply probe.Reply) string {
+	note := ttlNote(reply.TTL) + stateNote(reply.Open)
+	if reply.Attempt == 0 {
+		return note
+	}
+	return note + fmt.Sprintf(" (retransmit #%d)", reply.Attempt)
+}
+
+// The reply's TTL, which says roughly how many hops away the host is
+func ttlNote(ttl int) string {
+	if ttl == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" ttl=%d", ttl)
+}
 
-	addrs, err := net.LookupHost(remoteHost)
+// One line per address, in the order the resolver returned them
+func measureAll(localAddr, remoteHost string, port uint16, count int) {
+	rs, err := resolveEach(localAddr, remoteHost)
 	if err != nil {
-		log.Fatalf("Error resolving %s. %s\n", remoteHost, err)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if textOutput() {
+		fmt.Println("Measuring round-trip latency from", localAddr, "to", len(rs), "addresses of", remoteHost, via(port))
 	}
-	remoteAddr := addrs[0]
 
-	go func() {
-		receiveTime = receiveSynAck(localAddr, remoteAddr)
-		wg.Done()
-	}()
+	var results []Result
+	var limits thresholds
+	for _, r := range rs {
+		stats, err := measureResolved(localAddr, r, port, count)
+		switch {
+		case *csvParam:
+			// measureResolved wrote the rows
+		case *jsonParam:
+			results = append(results, newResult(remoteHost, port, stats, err))
+		case err != nil:
+			fmt.Printf("%15s: %s\n", r.addr, err)
+		case count == 1:
+			fmt.Printf("%15s: %v\n", r.addr, stats.Mean)
+		default:
+			fmt.Printf("%15s: %v, %.0f%% loss\n", r.addr, stats.Mean, stats.Loss()*100)
+		}
+		limits.check(r.addr, stats, err)
+	}
+	if *jsonParam {
+		printJSON(results)
+	}
+	limits.exit()
+}
 
-	time.Sleep(1 * time.Millisecond)
-	sendTime := sendSyn(localAddr, remoteAddr, port)
+// One line per port, in the order they were given. They are probed one
+// after another, so that they don't compete and skew each other's RTTs.
+// No reply at all usually means a firewall is dropping the SYN.
+func measurePorts(localAddr, remoteHost string, ports []uint16, count int) {
+	r, err := resolve(localAddr, remoteHost)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if textOutput() {
+		fmt.Println("Measuring round-trip latency from", localAddr, "to", remoteHost, "on", len(ports), "ports")
+		printResolution(r)
+	}
 
-	wg.Wait()
-	return receiveTime.Sub(sendTime)
+	var results []Result
+	var limits thresholds
+	for _, port := range ports {
+		stats, err := measureResolved(localAddr, r, port, count)
+		switch {
+		case *csvParam:
+			// measureResolved wrote the rows
+		case *jsonParam:
+			results = append(results, newResult(remoteHost, port, stats, err))
+		case errors.Is(err, probe.ErrTimeout):
+			fmt.Printf("%5d: filtered (no reply)\n", port)
+		case err != nil:
+			fmt.Printf("%5d: %s\n", port, err)
+		case count == 1:
+			fmt.Printf("%5d: %-6s %v\n", port, portState(stats.Open), stats.Mean)
+		default:
+			fmt.Printf("%5d: %-6s %v, %.0f%% loss\n", port, portState(stats.Open), stats.Mean, stats.Loss()*100)
+		}
+		limits.check(fmt.Sprintf("%s port %d", remoteHost, port), stats, err)
+	}
+	if *jsonParam {
+		printJSON(results)
+	}
+	limits.exit()
 }
 
-func chooseInterface() string {
-	interfaces, err := net.Interfaces()
+// A SYN-ACK means something is listening, a RST that nothing is
+func portState(open bool) string {
+	if open {
+		return "open"
+	}
+	return "closed"
+}
+
+// An ICMP echo reply says nothing about ports
+func stateNote(open bool) string {
+	if *icmpParam {
+		return ""
+	}
+	return " (" + portState(open) + ")"
+}
+
+// Like ping, probe remoteHost every -I until Ctrl-C, then print a
+// summary. A probe in progress finishes first.
+func watch(localAddr, remoteHost string, port uint16) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	r, err := resolve(localAddr, remoteHost)
 	if err != nil {
-		log.Fatalf("net.Interfaces: %s", err)
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	for _, iface := range interfaces {
-		// Skip loopback
-		if iface.Name == "lo" {
-			continue
+	if textOutput() {
+		printResolution(r)
+	}
+	warmup(localAddr, r, port)
+
+	var samples []time.Duration
+	var jit jitter
+	var lastErr error
+	sent := 0
+	for {
+		sent++
+		reply, err := probeResolved(localAddr, r, port)
+		if err == nil {
+			samples = append(samples, reply.RTT)
+			jit.add(reply.RTT)
+		} else {
+			lastErr = err
+			jit.lost()
 		}
-		addrs, err := iface.Addrs()
-		// Skip if error getting addresses
+		switch {
+		case *csvParam:
+			// probeResolved wrote the row
+		case *jsonParam:
+			stats := Stats{Addr: r.addr, Mean: reply.RTT, TTL: reply.TTL, Open: reply.Open, Resolve: r.took}
+			printJSON(newResult(remoteHost, port, stats, err))
+		case err != nil:
+			fmt.Printf("%d: %s\n", sent, err)
+		default:
+			fmt.Printf("%d: %v%s\n", sent, reply.RTT, replyNote(reply))
+		}
+
+		select {
+		case <-interrupt:
+			stats := newStats(sent, samples)
+			stats.Jitter = jit.value()
+			if textOutput() {
+				fmt.Printf("\n--- %s latency statistics ---\n", remoteHost)
+				fmt.Printf("%d probes sent, %d received, %.0f%% loss\n", stats.Sent, stats.Received, stats.Loss()*100)
+				if stats.Received > 0 {
+					fmt.Println(stats)
+					printDistribution(stats)
+				}
+			}
+			// Like measure, it only failed if every probe did
+			if stats.Received > 0 {
+				lastErr = nil
+			}
+			var limits thresholds
+			limits.check(remoteHost, stats, lastErr)
+			limits.exit()
+			return
+		case <-time.After(*delayParam):
+		}
+	}
+}
+
+// Probe remoteHost count times. A probe that fails is counted as lost and
+// left out of the stats, it's only an error if they all fail.
+// Each sample is printed as it arrives when there is more than one,
+// unless the output is JSON or one of several hosts or addresses.
+func measure(localAddr, remoteHost string, port uint16, count int) (Stats, error) {
+	if count < 1 {
+		return Stats{}, fmt.Errorf("measure: count must be at least 1, got %d", count)
+	}
+
+	r, err := resolve(localAddr, remoteHost)
+	if err != nil {
+		csvSink.row(r, port, time.Now(), probe.Reply{}, err)
+		return Stats{}, err
+	}
+	if textOutput() && !manyTargets() {
+		printResolution(r)
+	}
+	return measureResolved(localAddr, r, port, count)
+}
+
+// Like measure, but to the address r.host already resolved to
+func measureResolved(localAddr string, r resolution, port uint16, count int) (Stats, error) {
+	warmup(localAddr, r, port)
+
+	printSamples := count > 1 && textOutput() && !manyTargets()
+	samples := make([]time.Duration, 0, count)
+	var ttl int
+	var open bool
+	var jit jitter
+	var lastErr error
+	for seq := 1; seq <= count; seq++ {
+		if seq > 1 {
+			time.Sleep(*delayParam)
+		}
+		reply, err := probeResolved(localAddr, r, port)
 		if err != nil {
-			log.Println("Error get addresses for interfaces %s. %s", iface.Name, err)
+			lastErr = err
+			jit.lost()
+			if printSamples {
+				fmt.Printf("%d: %s\n", seq, err)
+			}
 			continue
 		}
+		samples = append(samples, reply.RTT)
+		jit.add(reply.RTT)
+		ttl = reply.TTL
+		open = reply.Open
+		if printSamples {
+			fmt.Printf("%d: %v%s\n", seq, reply.RTT, replyNote(reply))
+		} else if count == 1 && reply.Attempt > 0 && textOutput() && !manyTargets() {
+			fmt.Printf("Reply was to retransmit #%d\n", reply.Attempt)
+		}
+	}
 
-		if len(addrs) > 0 {
-			// This one will do
-			return iface.Name
+	stats := newStats(count, samples)
+	stats.Addr = r.addr
+	stats.Resolve = r.took
+	stats.TTL = ttl
+	stats.Open = open
+	stats.Jitter = jit.value()
+	if stats.Received == 0 {
+		if count == 1 {
+			return stats, lastErr
 		}
+		return stats, fmt.Errorf("%s: all %d probes lost. Last error: %w", r.host, count, lastErr)
 	}
+	return stats, nil
+}
 
-	return ""
+// Resolves remoteHost afresh and probes it once. -listen uses this, as it
+// runs for long enough that the address may change. Returns the address
+// even if the probe fails, so that the failure says which address it was to.
+func latency(localAddr string, remoteHost string, port uint16) (string, probe.Reply, error) {
+	r, err := resolve(localAddr, remoteHost)
+	if err != nil {
+		csvSink.row(r, port, time.Now(), probe.Reply{}, err)
+		return "", probe.Reply{}, err
+	}
+	reply, err := probeResolved(localAddr, r, port)
+	return r.addr, reply, err
 }
 
-func interfaceAddress(ifaceName string) net.Addr {
-	iface, err := net.InterfaceByName(ifaceName)
+// A remote host, the address it resolved to, and how long that took
+type resolution struct {
+	host string
+	addr string
+	took time.Duration // 0 if host is already an address
+}
+
+// The first address remoteHost resolves to, timed, because a slow resolver
+// can easily take longer than the round-trip itself
+func resolve(localAddr, remoteHost string) (resolution, error) {
+	rs, err := resolveEach(localAddr, remoteHost)
 	if err != nil {
-		log.Fatalf("net.InterfaceByName for %s. %s", ifaceName, err)
+		return resolution{host: remoteHost}, err
 	}
-	addrs, err := iface.Addrs()
+	return rs[0], nil
+}
+
+// Every address remoteHost resolves to, for -all. They all came from the
+// one lookup, so they all have the time that took.
+func resolveEach(localAddr, remoteHost string) ([]resolution, error) {
+	start := time.Now()
+	addrs, err := resolveAll(localAddr, remoteHost)
 	if err != nil {
-		log.Fatalf("iface.Addrs: %s", err)
+		return nil, err
 	}
-	return addrs[0]
+	var took time.Duration
+	if net.ParseIP(stripZone(remoteHost)) == nil {
+		took = time.Since(start)
+	}
+	rs := make([]resolution, 0, len(addrs))
+	for _, addr := range addrs {
+		rs = append(rs, resolution{host: remoteHost, addr: addr, took: took})
+	}
+	return rs, nil
 }
 
-func printHelp() {
-	help := `
-	USAGE: latency [-h] [-a] [-i iface] [-p port] <remote>
-	Where 'remote' is an ip address or host name.
-	Default port is 80
-	-h: Help
-	-a: Run auto test against several well known sites
-	`
-	fmt.Println(help)
+func printResolution(r resolution) {
+	if r.took > 0 {
+		fmt.Printf("Resolved %s to %s in %v\n", r.host, r.addr, r.took)
+	}
 }
 
-func sendSyn(laddr, raddr string, port uint16) time.Time {
+// The first probes to a host are often slower, while the ARP entry, route
+// cache and conntrack warm up. -warmup sends this many, -I apart like the
+// rest, and throws the results away, so they don't skew the stats or any
+// of the outputs.
+func warmup(localAddr string, r resolution, port uint16) {
+	for i := 0; i < *warmupParam; i++ {
+		probe.ProbeAddr(localAddr, r.addr, port, probeOptions())
+		time.Sleep(*delayParam)
+	}
+}
 
-	packet := TCPHeader{
-		Source:      0xaa47, // Random ephemeral port
-		Destination: port,
-		SeqNum:      rand.Uint32(),
-		AckNum:      0,
-		DataOffset:  5,      // 4 bits
-		Reserved:    0,      // 3 bits
-		ECN:         0,      // 3 bits
-		Ctrl:        2,      // 6 bits (000010, SYN bit set)
-		Window:      0xaaaa, // The amount of data that it is able to accept in bytes
-		Checksum:    0,      // Kernel will set this if it's 0
-		Urgent:      0,
-		Options:     []TCPOption{},
+func probeOptions() probe.Options {
+	opts := probe.Options{
+		Timeout:      *waitParam,
+		SynAckWindow: *retransParam,
+		BusyPoll:     *busyParam,
+		Retries:      *retriesParam,
+		SourcePort:   uint16(*srcPortParam),
+		TTL:          *ttlParam,
+		ICMP:         *icmpParam,
+		Device:       *ifaceParam,
+		Connect:      *connectParam,
+		Window:       uint16(*winParam),
+		MSS:          uint16(*mssParam),
 	}
+	if *verboseParam {
+		opts.Logger = log.New(os.Stderr, "", 0)
+	}
+	return opts
+}
 
-	data := packet.Marshal()
-	packet.Checksum = Csum(data, to4byte(laddr), to4byte(raddr))
+// One probe of the address that r.host resolved to
+func probeResolved(localAddr string, r resolution, port uint16) (probe.Reply, error) {
+	remoteHost, remoteAddr := r.host, r.addr
 
-	data = packet.Marshal()
+	if *arpParam {
+		printNeighborResolution(remoteAddr)
+	}
 
-	//fmt.Printf("% x\n", data)
+	var before *hostState
+	if *kstatsParam {
+		before = printHostState("Before", remoteAddr, nil)
+	}
 
-	conn, err := net.Dial("ip4:tcp", raddr)
+	sent := time.Now()
+	reply, err := probe.ProbeAddr(localAddr, remoteAddr, port, probeOptions())
+	csvSink.row(r, port, sent, reply, err)
+	if err == probe.ErrTimeout {
+		statsdSink.lost(remoteHost)
+	}
 	if err != nil {
-		log.Fatalf("Dial: %s\n", err)
+		return probe.Reply{}, err
 	}
 
-	sendTime := time.Now()
-
-	numWrote, err := conn.Write(data)
-	if err != nil {
-		log.Fatalf("Write: %s\n", err)
+	if before != nil {
+		printHostState("After", remoteAddr, before)
 	}
-	if numWrote != len(data) {
-		log.Fatalf("Short write. Wrote %d/%d bytes\n", numWrote, len(data))
+	// Only a SYN-ACK gets retransmitted
+	if *retransParam > 0 && reply.Open {
+		printRetransmits(reply.Retransmits)
 	}
 
-	conn.Close()
+	statsdSink.timing(remoteHost, reply.RTT)
+	return reply, nil
+}
 
-	return sendTime
+// Intervals between the first SYN-ACK and each retransmit of it, which
+// shows the server's SYN-ACK RTO and backoff.
+func printRetransmits(retransmits []time.Duration) {
+	if len(retransmits) == 0 {
+		printDiagnostic("SYN-ACK retransmits: none within %v\n", *retransParam)
+		return
+	}
+	for i, interval := range retransmits {
+		printDiagnostic("SYN-ACK retransmit %d: +%v\n", i+1, interval)
+	}
 }
 
-func to4byte(addr string) [4]byte {
-	parts := strings.Split(addr, ".")
-	b0, err := strconv.Atoi(parts[0])
+// Done before the SYN is sent, so that the reported latency is the TCP
+// round-trip only, and the ARP cost is shown separately.
+func printNeighborResolution(remoteAddr string) {
+	hop, took, cached, err := resolveNeighbor(remoteAddr, time.Second)
 	if err != nil {
-		log.Fatalf("to4byte: %s (latency works with IPv4 addresses only, but not IPv6!)\n", err)
+		log.Println("include-arp:", err)
+		return
+	}
+	if cached {
+		printDiagnostic("ARP: next hop %s already resolved\n", hop)
+		return
+	}
+	printDiagnostic("ARP: next hop %s resolved in %v\n", hop, took)
+}
+
+// Addresses of remoteHost in the family of localAddr, within -dns-timeout
+func resolveAll(localAddr, remoteHost string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *dnsParam)
+	defer cancel()
+	addrs, err := probe.ResolveAll(ctx, localAddr, remoteHost)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("Timed out resolving %s after %v", remoteHost, *dnsParam)
 	}
-	b1, _ := strconv.Atoi(parts[1])
-	b2, _ := strconv.Atoi(parts[2])
-	b3, _ := strconv.Atoi(parts[3])
-	return [4]byte{byte(b0), byte(b1), byte(b2), byte(b3)}
+	return addrs, err
 }
 
-func receiveSynAck(localAddress, remoteAddress string) time.Time {
-	netaddr, err := net.ResolveIPAddr("ip4", localAddress)
+// Best effort, so errors are logged and otherwise ignored
+func printHostState(when, remoteAddr string, before *hostState) *hostState {
+	state, err := readHostState(remoteAddr)
 	if err != nil {
-		log.Fatalf("net.ResolveIPAddr: %s. %s\n", localAddress, netaddr)
+		log.Println("kstats:", err)
+		return nil
 	}
+	printDiagnostic("%s: %s\n", when, state)
+	if before != nil {
+		printDiagnostic("Kernel TCP: %s\n", state.tcpDiff(before))
+	}
+	return state
+}
 
-	conn, err := net.ListenIP("ip4:tcp", netaddr)
+// -include-arp, -kstats and -synack-window lines. With -json or -csv they go
+// to stderr, so that stdout can still be parsed.
+func printDiagnostic(format string, args ...interface{}) {
+	out := os.Stdout
+	if !textOutput() {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, format, args...)
+}
+
+// Returns an empty string if none of the interfaces will do
+func chooseInterface() (string, error) {
+	interfaces, err := net.Interfaces()
 	if err != nil {
-		log.Fatalf("ListenIP: %s\n", err)
+		return "", fmt.Errorf("net.Interfaces: %s", err)
 	}
-	var receiveTime time.Time
-	for {
-		buf := make([]byte, 1024)
-		numRead, raddr, err := conn.ReadFrom(buf)
+	for _, iface := range interfaces {
+		// Skip loopback
+		if iface.Name == "lo" {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		// Skip if error getting addresses
 		if err != nil {
-			log.Fatalf("ReadFrom: %s\n", err)
+			log.Printf("Error get addresses for interfaces %s. %s\n", iface.Name, err)
+			continue
+		}
+
+		if len(addrs) > 0 {
+			// This one will do
+			return iface.Name, nil
 		}
-		if raddr.String() != remoteAddress {
-			// this is not the packet we are looking for
+	}
+
+	return "", nil
+}
+
+// First address of the requested family on the interface. For IPv6 a
+// global address is preferred, unless the remote is link-local, in which
+// case so is ours and it gets the zone it needs, e.g. fe80::1%eth0
+func interfaceAddress(ifaceName string, useIPv6, linkLocal bool) (string, error) {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return "", fmt.Errorf("net.InterfaceByName for %s. %s", ifaceName, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("iface.Addrs: %s", err)
+	}
+
+	var fallback string
+	for _, addr := range addrs {
+		ip := net.ParseIP(strings.Split(addr.String(), "/")[0]) // Clean addresses like 192.168.1.30/24
+		if ip == nil || (ip.To4() == nil) != useIPv6 {
 			continue
 		}
-		receiveTime = time.Now()
-		//fmt.Printf("Received: % x\n", buf[:numRead])
-		tcp := NewTCPHeader(buf[:numRead])
-		// Closed port gets RST, open port gets SYN ACK
-		if tcp.HasFlag(RST) || (tcp.HasFlag(SYN) && tcp.HasFlag(ACK)) {
-			break
+		if !useIPv6 {
+			return ip.String(), nil
+		}
+		if ip.IsLinkLocalUnicast() {
+			if linkLocal {
+				return ip.String() + "%" + ifaceName, nil
+			}
+			if fallback == "" {
+				fallback = ip.String() + "%" + ifaceName
+			}
+			continue
+		}
+		if linkLocal {
+			continue
 		}
+		return ip.String(), nil
 	}
-	return receiveTime
+	if fallback != "" {
+		return fallback, nil
+	}
+
+	family := "IPv4"
+	if useIPv6 {
+		family = "IPv6"
+	}
+	return "", fmt.Errorf("Interface %s has no suitable %s address", ifaceName, family)
+}
+
+func printHelp() {
+	help := `
+	USAGE: latency [-h] [-a] [-f file] [-all] [-6] [-json | -csv] [-c count] [-warmup n] [-t] [-I interval] [-hist] [-w timeout] [-max rtt] [-maxloss percent] [-r retries] [-i iface] [-p ports] [-sp port] [-ttl n] [-win size] [-mss size] [-icmp | -connect] <remote>
+	Where 'remote' is an ip address or host name.
+	Default port is 80
+	-p <ports>: Port to probe, or a list like 80,443,8000-8010 to probe each in turn and
+		show whether it's open (SYN-ACK), closed (RST) or filtered (no reply)
+	-i <iface>: Probe from this interface's address. On Linux the sockets are also bound to
+		the interface itself (SO_BINDTODEVICE), so probes really do go out that way
+	-sp <port>: Send the SYN from this source port, instead of a random one. 0 means random
+	-icmp: Time an ICMP echo (ping) instead of a TCP SYN, with the same output and stats,
+		for hosts that don't listen on any TCP port, or to compare the two
+	-connect: Time a normal TCP connect (SYN, SYN-ACK, ACK) instead of a raw SYN. Doesn't need
+		root, and is used automatically, with a warning, when raw sockets aren't permitted.
+		-ttl and -busy-poll don't apply, and -sp and -synack-window can't be used
+	-win <size>, -mss <size>: Send the SYN with this window, and with an MSS option of this
+		size, so that it looks like a normal client's, e.g. -win 64240 -mss 1460
+	-ttl <n>: Send the SYN with this IP TTL (hop limit for IPv6). Replies always show the TTL
+		they arrived with, as ttl=N
+	-h: Help
+	-a: Run auto test against several well known sites
+	-c <count>: Send this many probes and print min/avg/max/stddev and jitter (default 1)
+	-v: Verbose. Dump the SYN sent and every packet received, decoded and in hex, on stderr,
+		with the reason for skipping any that didn't match (remote address, ports, ack, checksum)
+	-json: Print one JSON object per host, or an array of them with -a
+	-csv: Print a header row then one row per probe:
+		host,addr,port,latency_ms,timed_out,timestamp,state,resolve_ms.
+		Timestamps are RFC3339, so rows from appended runs stay in order
+	-warmup <n>: Send n probes first, -I apart, and leave them out of the results. The first
+		probes to a host are often slow while ARP, the route cache and conntrack warm up
+	-t: Keep probing until interrupted with Ctrl-C, then print a summary
+	-I <duration>: Wait this long between probes with -c or -t (default 1s)
+	-hist: With -c or -t, also print a histogram of the RTTs, in millisecond buckets.
+		The p50/p90/p95/p99 percentiles are always printed with more than one reply
+	-w <duration>: How long to wait for each reply before it counts as lost (default 2s)
+	-max <duration>, -maxloss <percent>: For cron or Nagios style checks. After measuring,
+		exit 2 if the average RTT is over -max, or 3 if more than -maxloss percent of the
+		probes were lost, with a one line reason. Otherwise it exits 1 if any measurement
+		failed, as usual, and 0 if not
+	-r <retries>: If there's no reply within -w, send the SYN again, up to this many times
+	-f <file>: Measure each host in the file, which has one host or host:port per line.
+		Blank lines and lines starting with # are ignored
+	-all: Measure each address the host resolves to, one line per address
+	-6: Use IPv6 (implied if 'remote' is an IPv6 address). A link-local 'remote' needs a zone,
+		as in fe80::1%eth0, or -i to take it from
+	-busy-poll: Busy-poll the receive socket instead of blocking. Can shave wakeup latency
+		off the measurement, but uses a full CPU core while waiting (Linux only)
+	-statsd <host:port>: Also send each RTT to StatsD as a latency.rtt timing, tagged with the host.
+		They're batched a line each, and sent every second, whenever a datagram is full, and on exit
+	-listen <addr>: Run as a daemon, probing the -f or -a targets, or 'remote', every -I, and
+		serve latency_rtt_seconds and latency_probe_failures_total on http://<addr>/metrics
+	-synack-window <duration>: After the SYN-ACK, listen this long for the server to retransmit it
+		and print the intervals. The kernel will normally answer the SYN-ACK with a RST, which
+		stops retransmits, so drop those first, e.g.:
+		iptables -A OUTPUT -p tcp -d <remote> --tcp-flags RST RST -j DROP
+	-include-arp: Resolve the next hop's ARP entry first and report how long it took (Linux only)
+	-dns-timeout <duration>: Give up on a host name that hasn't resolved after this long (default 3s)
+	-kstats: Show kernel neighbor (ARP) and TCP stats before and after probing (Linux only)
+	`
+	fmt.Println(help)
+}
+
+// As in fe80::1%eth0
+func stripZone(addr string) string {
+	return strings.Split(addr, "%")[0]
 }
@@ -0,0 +1,98 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	rttGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "latency_rtt_seconds",
+		Help: "Round-trip time of the last probe that got a reply.",
+	}, []string{"host", "addr", "port"})
+
+	failureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_probe_failures_total",
+		Help: "Probes that timed out or could not be sent.",
+	}, []string{"host", "port"})
+)
+
+func init() {
+	prometheus.MustRegister(rttGauge, failureCounter)
+}
+
+// -listen probes the -f targets, the -a ones, or the remote host
+func listenTargets(remoteHost string, port uint16) ([]target, error) {
+	if *fileParam != "" {
+		return readTargets(*fileParam, port)
+	}
+	if *autoParam {
+		var targets []target
+		for name, host := range defaultHosts {
+			targets = append(targets, target{name, host, port})
+		}
+		return targets, nil
+	}
+	if remoteHost == "" {
+		return nil, fmt.Errorf("-listen needs -f, -a or a remote address")
+	}
+	return []target{{remoteHost, remoteHost, port}}, nil
+}
+
+// Probes every target every -I, each in its own goroutine, and serves the
+// results on listenAddr at /metrics until the server fails.
+func serveMetrics(localAddr, listenAddr string, targets []target) error {
+	for _, t := range targets {
+		go monitor(localAddr, t)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	fmt.Println("Serving metrics for", len(targets), "targets on", listenAddr)
+	return http.ListenAndServe(listenAddr, mux)
+}
+
+// A failed probe removes the target's RTT, so that a host that went away
+// doesn't keep reporting its last good one. So does the host moving to a
+// new address, as the RTT is exported under the address it was to.
+func monitor(localAddr string, t target) {
+	port := strconv.Itoa(int(t.port))
+	lastAddr := "" // Of the RTT being exported, if there is one
+	for {
+		addr, reply, err := latency(localAddr, t.host, t.port)
+		if lastAddr != "" && (err != nil || addr != lastAddr) {
+			rttGauge.DeleteLabelValues(t.host, lastAddr, port)
+			lastAddr = ""
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", t.host, err)
+			failureCounter.WithLabelValues(t.host, port).Inc()
+		} else {
+			rttGauge.WithLabelValues(t.host, addr, port).Set(reply.RTT.Seconds())
+			lastAddr = addr
+		}
+		time.Sleep(*delayParam)
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ATF_COM from linux/if_arp.h: the neighbor entry has a hardware address
+	arpComplete = 0x2
+
+	// How often to re-read /proc/net/arp while waiting for resolution
+	arpPollInterval = 100 * time.Microsecond
+)
+
+// Snapshot of what the kernel knows about the path to a remote address.
+// Read from /proc, so this is best effort and IPv4 only.
+type hostState struct {
+	NextHop  string // Gateway, or the remote address itself if on-link
+	Device   string
+	HWAddr   string // Empty if there is no complete neighbor entry
+	Resolved bool
+	TCP      map[string]int64 // Tcp: counters from /proc/net/snmp
+}
+
+func readHostState(remoteAddr string) (*hostState, error) {
+	state := &hostState{}
+	var err error
+
+	state.NextHop, state.Device, err = nextHop(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	state.HWAddr, state.Resolved, err = neighbor(state.NextHop)
+	if err != nil {
+		return nil, err
+	}
+	state.TCP, err = tcpCounters()
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (h *hostState) String() string {
+	if h.Resolved {
+		return fmt.Sprintf("next hop %s on %s: neighbor resolved (%s)", h.NextHop, h.Device, h.HWAddr)
+	}
+	return fmt.Sprintf("next hop %s on %s: no neighbor entry, first probe will include ARP", h.NextHop, h.Device)
+}
+
+// Kernel TCP counters that changed between before and after
+func (h *hostState) tcpDiff(before *hostState) string {
+	var parts []string
+	for _, name := range []string{"OutSegs", "InSegs", "RetransSegs", "OutRsts", "InErrs"} {
+		parts = append(parts, fmt.Sprintf("%s +%d", name, h.TCP[name]-before.TCP[name]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Make the kernel resolve the next hop towards remoteAddr, and time how long
+// it takes for the neighbor entry to become complete. A zero duration with
+// cached true means the entry was already there.
+// Resolution is triggered by sending a UDP datagram to the discard port of
+// the next hop, so the timing is only as precise as arpPollInterval.
+func resolveNeighbor(remoteAddr string, timeout time.Duration) (string, time.Duration, bool, error) {
+	hop, _, err := nextHop(remoteAddr)
+	if err != nil {
+		return "", 0, false, err
+	}
+	_, resolved, err := neighbor(hop)
+	if err != nil {
+		return hop, 0, false, err
+	}
+	if resolved {
+		return hop, 0, true, nil
+	}
+
+	conn, err := net.Dial("udp4", net.JoinHostPort(hop, "9"))
+	if err != nil {
+		return hop, 0, false, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return hop, 0, false, err
+	}
+	for time.Since(start) < timeout {
+		_, resolved, err = neighbor(hop)
+		if err != nil {
+			return hop, 0, false, err
+		}
+		if resolved {
+			return hop, time.Since(start), false, nil
+		}
+		time.Sleep(arpPollInterval)
+	}
+	return hop, 0, false, fmt.Errorf("resolveNeighbor: %s not resolved after %v", hop, timeout)
+}
+
+// Longest prefix match of remoteAddr against /proc/net/route.
+// Returns the gateway (or remoteAddr if on-link) and the device.
+// The kernel prints the addresses as host byte order integers, so they
+// are decoded in native order, which isn't little endian everywhere.
+func nextHop(remoteAddr string) (string, string, error) {
+	remote := net.ParseIP(remoteAddr).To4()
+	if remote == nil {
+		return "", "", fmt.Errorf("nextHop: %s is not an IPv4 address", remoteAddr)
+	}
+	dst := binary.NativeEndian.Uint32(remote)
+
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	var hop, device string
+	bestMask := -1
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		routeDst, err1 := strconv.ParseUint(fields[1], 16, 32)
+		gateway, err2 := strconv.ParseUint(fields[2], 16, 32)
+		mask, err3 := strconv.ParseUint(fields[7], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		if dst&uint32(mask) != uint32(routeDst) {
+			continue
+		}
+		maskLen := bits.OnesCount32(uint32(mask))
+		if maskLen <= bestMask {
+			continue
+		}
+		bestMask = maskLen
+		device = fields[0]
+		if gateway == 0 {
+			hop = remoteAddr
+		} else {
+			gw := make(net.IP, 4)
+			binary.NativeEndian.PutUint32(gw, uint32(gateway))
+			hop = gw.String()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if bestMask < 0 {
+		return "", "", fmt.Errorf("nextHop: no route to %s", remoteAddr)
+	}
+	return hop, device, nil
+}
+
+// Look up addr in /proc/net/arp. Returns its hardware address and
+// whether the entry is complete.
+func neighbor(addr string) (string, bool, error) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != addr {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 32)
+		if err != nil {
+			return "", false, err
+		}
+		if flags&arpComplete == 0 {
+			return "", false, nil
+		}
+		return fields[3], true, nil
+	}
+	return "", false, scanner.Err()
+}
+
+// The Tcp: section of /proc/net/snmp, which is a header line of names
+// followed by a line of values.
+func tcpCounters() (map[string]int64, error) {
+	f, err := os.Open("/proc/net/snmp")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "Tcp:" {
+			continue
+		}
+		if names == nil {
+			names = fields[1:]
+			continue
+		}
+		counters := make(map[string]int64, len(names))
+		for i, value := range fields[1:] {
+			if i >= len(names) {
+				break
+			}
+			counters[names[i]], _ = strconv.ParseInt(value, 10, 64)
+		}
+		return counters, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("tcpCounters: no Tcp section in /proc/net/snmp")
+}
@@ -0,0 +1,42 @@
+//go:build !linux
+
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+type hostState struct{}
+
+func readHostState(remoteAddr string) (*hostState, error) {
+	return nil, errors.New("kernel host state is only available on Linux")
+}
+
+func (h *hostState) String() string {
+	return ""
+}
+
+func (h *hostState) tcpDiff(before *hostState) string {
+	return ""
+}
+
+func resolveNeighbor(remoteAddr string, timeout time.Duration) (string, time.Duration, bool, error) {
+	return "", 0, false, errors.New("neighbor resolution timing is only available on Linux")
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/grahamking/latency/probe"
+)
+
+// One target's measurement, as written by -json
+type Result struct {
+	Host      string  `json:"host"`
+	Addr      string  `json:"addr"`
+	Port      uint16  `json:"port"`
+	LatencyMs float64 `json:"latency_ms"`
+	JitterMs  float64 `json:"jitter_ms,omitempty"`
+	ResolveMs float64 `json:"resolve_ms"`
+	TimedOut  bool    `json:"timed_out"`
+	State     string  `json:"state,omitempty"` // open or closed, if there was a reply
+	TTL       int     `json:"ttl,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// err is the error from measure, if any
+func newResult(host string, port uint16, stats Stats, err error) Result {
+	result := Result{
+		Host:      host,
+		Addr:      stats.Addr,
+		Port:      port,
+		LatencyMs: ms(stats.Mean),
+		JitterMs:  ms(stats.Jitter),
+		ResolveMs: ms(stats.Resolve),
+		TTL:       stats.TTL,
+	}
+	if errors.Is(err, probe.ErrTimeout) {
+		result.TimedOut = true
+	} else if err != nil {
+		result.Error = err.Error()
+	} else if !*icmpParam {
+		result.State = portState(stats.Open)
+	}
+	return result
+}
+
+func printJSON(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "json:", err)
+		return
+	}
+	fmt.Println(string(data))
+}
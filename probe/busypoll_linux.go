@@ -0,0 +1,71 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Whether Options.BusyPoll works on this OS
+const BusyPollSupported = true
+
+// Like conn.ReadFrom, but spins on a non-blocking recvfrom instead of
+// letting the runtime park the goroutine until the socket is readable.
+// That saves the wakeup latency at the cost of a full CPU core while
+// waiting. A zero deadline means wait forever.
+func busyReadFrom(conn *net.IPConn, buf []byte, deadline time.Time) (int, net.Addr, int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, nil, 0, err
+	}
+
+	oob := make([]byte, 64)
+	var numRead, oobn int
+	var from syscall.Sockaddr
+	var readErr error
+	err = rc.Read(func(fd uintptr) bool {
+		for {
+			numRead, oobn, _, from, readErr = syscall.Recvmsg(int(fd), buf, oob, syscall.MSG_DONTWAIT)
+			if readErr != syscall.EAGAIN && readErr != syscall.EWOULDBLOCK {
+				return true
+			}
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				readErr = os.ErrDeadlineExceeded
+				return true
+			}
+		}
+	})
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if readErr != nil {
+		return 0, nil, 0, readErr
+	}
+
+	var raddr *net.IPAddr
+	switch sa := from.(type) {
+	case *syscall.SockaddrInet4:
+		raddr = &net.IPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3])}
+	case *syscall.SockaddrInet6:
+		raddr = &net.IPAddr{IP: append(net.IP(nil), sa.Addr[:]...)}
+	}
+	numRead, ttl, err := packetTTL(buf, numRead, oob[:oobn], raddr != nil && raddr.IP.To4() != nil)
+	return numRead, raddr, ttl, err
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Whether Options.BusyPoll works on this OS
+const BusyPollSupported = false
+
+func busyReadFrom(conn *net.IPConn, buf []byte, deadline time.Time) (int, net.Addr, int, error) {
+	return 0, nil, 0, errors.New("busy polling is only supported on Linux")
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Like probeOnce, but times a normal TCP connect, which needs no
+// privileges. Connect returns once the SYN-ACK is in and the ACK sent, so
+// it is the same round trip, plus a little more of the kernel's time. A
+// closed port refuses the connection with a RST, which is a reply too.
+func connectOnce(localAddr, remoteAddr string, port uint16, opts Options) (Reply, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(localAddr, strconv.Itoa(int(opts.SourcePort))))
+	if err != nil {
+		return Reply{}, err
+	}
+	dialer := net.Dialer{Timeout: opts.Timeout, LocalAddr: laddr}
+	if opts.Device != "" {
+		dialer.Control = func(network, address string, rc syscall.RawConn) error {
+			return bindRawConnToDevice(rc, opts.Device)
+		}
+	}
+
+	start := time.Now()
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(remoteAddr, strconv.Itoa(int(port))))
+	rtt := time.Since(start)
+	if err == nil {
+		conn.Close()
+		return Reply{RTT: rtt, Open: true}, nil
+	}
+	if refused(err) {
+		return Reply{RTT: rtt}, nil
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return Reply{}, ErrTimeout
+	}
+	return Reply{}, err
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Sends and receives only on the named interface, whatever the routing
+// table says, with SO_BINDTODEVICE
+func bindToDevice(conn syscall.Conn, device string) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return bindRawConnToDevice(rc, device)
+}
+
+// For a net.Dialer's Control, which only has the RawConn
+func bindRawConnToDevice(rc syscall.RawConn, device string) error {
+	var bindErr error
+	err := rc.Control(func(fd uintptr) {
+		bindErr = syscall.BindToDevice(int(fd), device)
+	})
+	if err != nil {
+		return err
+	}
+	if bindErr == syscall.EPERM {
+		return fmt.Errorf("SO_BINDTODEVICE %s: %s. Binding to an interface needs root or CAP_NET_RAW on older kernels", device, bindErr)
+	}
+	if bindErr != nil {
+		return fmt.Errorf("SO_BINDTODEVICE %s: %s", device, bindErr)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import "syscall"
+
+// There's no SO_BINDTODEVICE here, so the sockets stay bound by address
+// only, to the interface's address.
+func bindToDevice(conn syscall.Conn, device string) error {
+	return nil
+}
+
+func bindRawConnToDevice(rc syscall.RawConn, device string) error {
+	return nil
+}
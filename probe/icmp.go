@@ -0,0 +1,130 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Protocol numbers, for icmp.ParseMessage
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+func icmpNetwork(addr string) string {
+	if isIPv6(addr) {
+		return "ip6:ipv6-icmp"
+	}
+	return "ip4:icmp"
+}
+
+// Like probeOnce, but times an ICMP echo request instead of a SYN. The
+// same socket sends and receives, so it is listening before the request
+// goes out. Every raw ICMP socket sees every echo reply, so ours is picked
+// out by its random ID and sequence number.
+func echoOnce(localAddr, remoteAddr string, opts Options) (Reply, error) {
+	laddr, err := net.ResolveIPAddr("ip", localAddr)
+	if err != nil {
+		return Reply{}, fmt.Errorf("net.ResolveIPAddr: %s. %s", localAddr, err)
+	}
+	raddr, err := net.ResolveIPAddr("ip", remoteAddr)
+	if err != nil {
+		return Reply{}, fmt.Errorf("net.ResolveIPAddr: %s. %s", remoteAddr, err)
+	}
+
+	conn, err := net.ListenIP(icmpNetwork(localAddr), laddr)
+	if err != nil {
+		return Reply{}, rawSocketError("ListenIP", err)
+	}
+	defer conn.Close()
+	if opts.Device != "" {
+		if err := bindToDevice(conn, opts.Device); err != nil {
+			return Reply{}, err
+		}
+	}
+
+	v6 := isIPv6(localAddr)
+	var request, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	protocol := protocolICMP
+	if v6 {
+		// The kernel fills in the ICMPv6 checksum, so Marshal doesn't
+		// need the pseudo header
+		request, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		protocol = protocolIPv6ICMP
+		enableHopLimit(conn)
+	}
+	if opts.TTL > 0 {
+		if err := setTTL(conn, opts.TTL, v6); err != nil {
+			return Reply{}, fmt.Errorf("Setting TTL: %s", err)
+		}
+	}
+
+	echo := &icmp.Echo{ID: rand.Intn(0x10000), Seq: rand.Intn(0x10000), Data: []byte("latency")}
+	msg, err := (&icmp.Message{Type: request, Body: echo}).Marshal(nil)
+	if err != nil {
+		return Reply{}, fmt.Errorf("Marshal: %s", err)
+	}
+
+	deadline := time.Now().Add(opts.Timeout)
+	conn.SetReadDeadline(deadline)
+	sendTime := time.Now()
+	if _, err := conn.WriteTo(msg, raddr); err != nil {
+		return Reply{}, fmt.Errorf("Write: %s", err)
+	}
+	logf(opts.Logger, "Sent echo request to %s: id=%d seq=%d\n  % x\n", raddr, echo.ID, echo.Seq, msg)
+
+	for {
+		buf := make([]byte, 1500)
+		numRead, from, ttl, err := readFrom(conn, buf, deadline, opts.BusyPoll)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return Reply{}, ErrTimeout
+			}
+			return Reply{}, fmt.Errorf("ReadFrom: %s", err)
+		}
+		if !fromAddr(from, raddr.IP) {
+			logf(opts.Logger, "Skipped packet from %s: wrong remote address, expected %s\n", from, raddr)
+			continue
+		}
+		receiveTime := time.Now()
+		reply, err := icmp.ParseMessage(protocol, buf[:numRead])
+		if err != nil {
+			logf(opts.Logger, "Skipped packet from %s: %s\n", from, err)
+			continue
+		}
+		body, ok := reply.Body.(*icmp.Echo)
+		if reply.Type != replyType || !ok {
+			logf(opts.Logger, "Skipped packet from %s: %v, not an echo reply\n", from, reply.Type)
+			continue
+		}
+		if body.ID != echo.ID || body.Seq != echo.Seq {
+			logf(opts.Logger, "Skipped packet from %s: echo reply id=%d seq=%d, expected id=%d seq=%d\n",
+				from, body.ID, body.Seq, echo.ID, echo.Seq)
+			continue
+		}
+		logf(opts.Logger, "Received echo reply from %s: id=%d seq=%d\n  % x\n", from, body.ID, body.Seq, buf[:numRead])
+		return Reply{RTT: receiveTime.Sub(sendTime), TTL: ttl}, nil
+	}
+}
@@ -0,0 +1,507 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+// Package probe measures TCP round-trip latency. It sends a SYN on a raw
+// socket and times how long the SYN-ACK (open port) or RST (closed port)
+// takes to come back. Raw sockets need root or CAP_NET_RAW.
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Used for a zero Options.Timeout
+const DefaultTimeout = 2 * time.Second
+
+// Linux's default ephemeral port range, net.ipv4.ip_local_port_range
+const (
+	minSourcePort = 32768
+	maxSourcePort = 60999
+)
+
+// Returned when there is no reply within Options.Timeout
+var ErrTimeout = errors.New("timed out")
+
+// The zero value is a plain probe with DefaultTimeout
+type Options struct {
+	// How long to wait for the reply to the SYN
+	Timeout time.Duration
+
+	// If non-zero, after a SYN-ACK keep listening this long for the
+	// server to retransmit it. The kernel normally answers an unexpected
+	// SYN-ACK with a RST, which stops retransmits, so outgoing RSTs to the
+	// remote have to be dropped (e.g. with iptables) for these to be seen.
+	SynAckWindow time.Duration
+
+	// Spin on a non-blocking socket while waiting, see BusyPollSupported
+	BusyPoll bool
+
+	// How many times to send the SYN again after Timeout without a reply
+	Retries int
+
+	// Send from this port instead of a random ephemeral one
+	SourcePort uint16
+
+	// If set, received packets that are skipped are logged here
+	Logger *log.Logger
+
+	// IP TTL, or IPv6 hop limit, of the SYN. 0 for the system default.
+	TTL int
+
+	// Time an ICMP echo request instead of a SYN, for hosts that don't
+	// listen on any TCP port. The port is ignored.
+	ICMP bool
+
+	// If set, send and receive only on this interface (Linux only, see
+	// bindToDevice), for hosts with several in the same subnet
+	Device string
+
+	// Time a normal TCP connect instead of a raw SYN, which doesn't need
+	// root. TTL, BusyPoll and SynAckWindow don't apply.
+	Connect bool
+
+	// The SYN's window, 0 for 0xaaaa. A SYN that doesn't look like a
+	// normal client's, with a window and an MSS option, may be dropped or
+	// rate-limited by some middleboxes.
+	Window uint16
+
+	// If non-zero, send an MSS option with this size, e.g. 1460
+	MSS uint16
+}
+
+// What came back from a probe
+type Reply struct {
+	// From sending the SYN to receiving the SYN-ACK or RST
+	RTT time.Duration
+
+	// Which SYN it was a reply to, 0 for the first one, k for retransmit #k
+	Attempt int
+
+	// Interval between the first SYN-ACK and each retransmit of it, only
+	// collected with Options.SynAckWindow
+	Retransmits []time.Duration
+
+	// IP TTL, or IPv6 hop limit, the reply arrived with. 0 if unknown.
+	TTL int
+
+	// The reply was a SYN-ACK, so the port is open. A RST means closed.
+	Open bool
+}
+
+// Round-trip latency from localAddr to remoteHost, which can be a host
+// name or an address. localAddr is an IP address of the interface to
+// probe from, and decides whether it's IPv4 or IPv6.
+// Resolving remoteHost gets DefaultTimeout too, so a stuck resolver
+// can't block forever.
+func Probe(localAddr, remoteHost string, port uint16) (time.Duration, error) {
+	opts := Options{Timeout: DefaultTimeout}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	remoteAddr, err := Resolve(ctx, localAddr, remoteHost)
+	if err != nil {
+		return 0, err
+	}
+	reply, err := ProbeAddr(localAddr, remoteAddr, port, opts)
+	return reply.RTT, err
+}
+
+// First address remoteHost resolves to in the same family as localAddr.
+// Hosts with both A and AAAA records resolve to both.
+func Resolve(ctx context.Context, localAddr, remoteHost string) (string, error) {
+	addrs, err := ResolveAll(ctx, localAddr, remoteHost)
+	if err != nil {
+		return "", err
+	}
+	return addrs[0], nil
+}
+
+// All the addresses remoteHost resolves to in the same family as
+// localAddr, for hosts behind round-robin DNS or anycast.
+func ResolveAll(ctx context.Context, localAddr, remoteHost string) ([]string, error) {
+	addrs, err := net.DefaultResolver.LookupHost(ctx, remoteHost)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving %s. %s", remoteHost, err)
+	}
+
+	useIPv6 := isIPv6(localAddr)
+	var matching []string
+	for _, addr := range addrs {
+		if isIPv6(addr) == useIPv6 {
+			matching = append(matching, addr)
+		}
+	}
+	if len(matching) > 0 {
+		return matching, nil
+	}
+	if useIPv6 {
+		return nil, fmt.Errorf("%s has no IPv6 address", remoteHost)
+	}
+	return nil, fmt.Errorf("%s has no IPv4 address", remoteHost)
+}
+
+// Like Probe, but to an address Resolve already found.
+// Returns ErrTimeout if the SYN and all opts.Retries retransmits of it got
+// no reply.
+func ProbeAddr(localAddr, remoteAddr string, port uint16, opts Options) (Reply, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	for attempt := 0; ; attempt++ {
+		var reply Reply
+		var err error
+		switch {
+		case opts.ICMP:
+			reply, err = echoOnce(localAddr, remoteAddr, opts)
+		case opts.Connect:
+			reply, err = connectOnce(localAddr, remoteAddr, port, opts)
+		default:
+			reply, err = probeOnce(localAddr, remoteAddr, port, opts)
+		}
+		if err == ErrTimeout && attempt < opts.Retries {
+			continue
+		}
+		reply.Attempt = attempt
+		return reply, err
+	}
+}
+
+// Each attempt has its own SYN, socket and source port, so a late reply
+// to an earlier attempt can't be mistaken for a reply to this one.
+func probeOnce(localAddr, remoteAddr string, port uint16, opts Options) (Reply, error) {
+	var received synAck
+	var receiveErr error
+
+	// A new port each time, so replies to concurrent probes, or another
+	// copy of latency, can be told apart. With a fixed port only the
+	// sequence number does that.
+	srcPort := opts.SourcePort
+	if srcPort == 0 {
+		srcPort = uint16(minSourcePort + rand.Intn(maxSourcePort-minSourcePort+1))
+	}
+	syn := newSyn(srcPort, port, opts)
+
+	// The SYN can only go once the receiver is listening, or the reply
+	// could arrive before there is a socket to see it
+	ready := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		received, receiveErr = receiveSynAck(localAddr, remoteAddr, syn, opts, ready)
+		close(done)
+	}()
+	select {
+	case <-ready:
+	case <-done:
+		return Reply{}, receiveErr
+	}
+
+	sendTime, err := sendSyn(localAddr, remoteAddr, syn, opts)
+	if err != nil {
+		// Let the receiver time out, so that its socket is closed before
+		// we return, otherwise a long run of failures leaks them
+		<-done
+		return Reply{}, err
+	}
+
+	<-done
+	if receiveErr != nil {
+		return Reply{}, receiveErr
+	}
+
+	reply := Reply{RTT: received.time.Sub(sendTime), TTL: received.ttl, Open: received.open}
+	prev := received.time
+	for _, t := range received.retransmits {
+		reply.Retransmits = append(reply.Retransmits, t.Sub(prev))
+		prev = t
+	}
+	return reply, nil
+}
+
+// The receiver needs the ports and sequence number of the SYN before it is
+// sent, to match the reply to it.
+func newSyn(srcPort, port uint16, opts Options) *TCPHeader {
+	syn := &TCPHeader{
+		Source:      srcPort,
+		Destination: port,
+		SeqNum:      rand.Uint32(),
+		AckNum:      0,
+		DataOffset:  5,      // 4 bits, set from the options below
+		Reserved:    0,      // 3 bits
+		ECN:         0,      // 3 bits
+		Ctrl:        2,      // 6 bits (000010, SYN bit set)
+		Window:      0xaaaa, // The amount of data that it is able to accept in bytes
+		Checksum:    0,      // Kernel will set this if it's 0
+		Urgent:      0,
+		Options:     []TCPOption{},
+	}
+	if opts.Window != 0 {
+		syn.Window = opts.Window
+	}
+	if opts.MSS != 0 {
+		syn.Options = append(syn.Options, mssOption(opts.MSS))
+	}
+	syn.DataOffset = uint8(syn.headerLen() / 4)
+	return syn
+}
+
+func sendSyn(laddr, raddr string, syn *TCPHeader, opts Options) (time.Time, error) {
+
+	packet := *syn
+	csum, err := checksumFor(packet.Marshal(), laddr, raddr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	packet.Checksum = csum
+
+	data := packet.Marshal()
+
+	conn, err := net.Dial(tcpNetwork(raddr), raddr)
+	if err != nil {
+		return time.Time{}, rawSocketError("Dial", err)
+	}
+	defer conn.Close()
+
+	if opts.Device != "" {
+		if err := bindToDevice(conn.(*net.IPConn), opts.Device); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if opts.TTL > 0 {
+		if err := setTTL(conn, opts.TTL, isIPv6(raddr)); err != nil {
+			return time.Time{}, fmt.Errorf("Setting TTL: %s", err)
+		}
+	}
+
+	sendTime := time.Now()
+
+	numWrote, err := conn.Write(data)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Write: %s", err)
+	}
+	if numWrote != len(data) {
+		return time.Time{}, fmt.Errorf("Short write. Wrote %d/%d bytes", numWrote, len(data))
+	}
+	logSegment(opts.Logger, &packet, data, "Sent to %s", raddr)
+
+	return sendTime, nil
+}
+
+// TCP checksum of data, which must have a zero checksum field, with a
+// pseudo header from srcAddr to dstAddr in whichever family they are.
+func checksumFor(data []byte, srcAddr, dstAddr string) (uint16, error) {
+	if isIPv6(dstAddr) {
+		src, err := to16byte(srcAddr)
+		if err != nil {
+			return 0, err
+		}
+		dst, err := to16byte(dstAddr)
+		if err != nil {
+			return 0, err
+		}
+		return Csum6(data, src, dst), nil
+	}
+	src, err := to4byte(srcAddr)
+	if err != nil {
+		return 0, err
+	}
+	dst, err := to4byte(dstAddr)
+	if err != nil {
+		return 0, err
+	}
+	return Csum(data, src, dst), nil
+}
+
+// Recompute the checksum of a received segment, which is from remoteAddr
+// to localAddr, and compare it to the one in the header.
+func validChecksum(data []byte, tcp *TCPHeader, remoteAddr, localAddr string) bool {
+	if len(data) < 20 {
+		return false
+	}
+	zeroed := make([]byte, len(data))
+	copy(zeroed, data)
+	zeroed[16], zeroed[17] = 0, 0
+	csum, err := checksumFor(zeroed, remoteAddr, localAddr)
+	return err == nil && csum == tcp.Checksum
+}
+
+func to4byte(addr string) ([4]byte, error) {
+	var b [4]byte
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		return b, fmt.Errorf("to4byte: %s is not an IPv4 address", addr)
+	}
+	copy(b[:], ip)
+	return b, nil
+}
+
+// Accepts a zone, which the pseudo header doesn't need
+func to16byte(addr string) ([16]byte, error) {
+	var b [16]byte
+	ip := parseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return b, fmt.Errorf("to16byte: %s is not an IPv6 address", addr)
+	}
+	copy(b[:], ip.To16())
+	return b, nil
+}
+
+// What receiveSynAck heard back
+type synAck struct {
+	time        time.Time
+	ttl         int
+	open        bool // SYN-ACK rather than RST
+	retransmits []time.Time
+}
+
+// Every raw socket sees every TCP segment, so when several probes run at
+// once each receiver has to pick out the replies to its own SYN, by remote
+// address, the ports, and the ack of the SYN's sequence number.
+// Returns ErrTimeout if there is no reply within opts.Timeout.
+// With opts.SynAckWindow, after a SYN-ACK keep listening that long and
+// also return the times of any retransmits of it.
+// ready is closed once the socket is listening, unless it fails first.
+func receiveSynAck(localAddress, remoteAddress string, syn *TCPHeader, opts Options, ready chan<- struct{}) (synAck, error) {
+	netaddr, err := net.ResolveIPAddr("ip", localAddress)
+	if err != nil {
+		return synAck{}, fmt.Errorf("net.ResolveIPAddr: %s. %s", localAddress, err)
+	}
+	remoteIP := parseIP(remoteAddress)
+
+	// Segments the kernel sends to itself can carry a partial checksum,
+	// left for a NIC to finish, so only check ones that came off the wire
+	checkCsum := !remoteIP.IsLoopback() && !remoteIP.Equal(parseIP(localAddress))
+
+	conn, err := net.ListenIP(tcpNetwork(localAddress), netaddr)
+	if err != nil {
+		return synAck{}, rawSocketError("ListenIP", err)
+	}
+	defer conn.Close()
+	if opts.Device != "" {
+		if err := bindToDevice(conn, opts.Device); err != nil {
+			return synAck{}, err
+		}
+	}
+	if isIPv6(localAddress) {
+		// Best effort, without it the reply's TTL is just unknown
+		enableHopLimit(conn)
+	}
+
+	var reply synAck
+	var isSynAck bool
+	replyDeadline := time.Now().Add(opts.Timeout)
+	conn.SetReadDeadline(replyDeadline)
+	close(ready)
+	for {
+		buf := make([]byte, 1024)
+		numRead, raddr, ttl, err := readFrom(conn, buf, replyDeadline, opts.BusyPoll)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return synAck{}, ErrTimeout
+			}
+			return synAck{}, fmt.Errorf("ReadFrom: %s", err)
+		}
+		reply.time = time.Now()
+		data := buf[:numRead]
+		tcp := NewTCPHeader(data)
+		if !fromAddr(raddr, remoteIP) {
+			// this is not the packet we are looking for
+			logSegment(opts.Logger, tcp, data, "Skipped packet from %s: wrong remote address, expected %s", raddr, remoteAddress)
+			continue
+		}
+		if why := tcp.mismatch(syn); why != "" {
+			logSegment(opts.Logger, tcp, data, "Skipped packet from %s: %s", raddr, why)
+			continue
+		}
+		if checkCsum && !validChecksum(data, tcp, remoteAddress, localAddress) {
+			logSegment(opts.Logger, tcp, data, "Skipped packet from %s: bad checksum %04x", raddr, tcp.Checksum)
+			continue
+		}
+		// Closed port gets RST, open port gets SYN ACK
+		isSynAck = tcp.HasFlag(SYN) && tcp.HasFlag(ACK)
+		if tcp.HasFlag(RST) || isSynAck {
+			logSegment(opts.Logger, tcp, data, "Received from %s", raddr)
+			reply.ttl = ttl
+			reply.open = isSynAck
+			break
+		}
+		logSegment(opts.Logger, tcp, data, "Skipped packet from %s: neither SYN-ACK nor RST", raddr)
+	}
+	if opts.SynAckWindow == 0 || !isSynAck {
+		return reply, nil
+	}
+
+	deadline := reply.time.Add(opts.SynAckWindow)
+	conn.SetReadDeadline(deadline)
+	for {
+		buf := make([]byte, 1024)
+		numRead, raddr, _, err := readFrom(conn, buf, deadline, opts.BusyPoll)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				break
+			}
+			return reply, fmt.Errorf("ReadFrom: %s", err)
+		}
+		if !fromAddr(raddr, remoteIP) {
+			continue
+		}
+		tcp := NewTCPHeader(buf[:numRead])
+		if !tcp.isReplyTo(syn) || (checkCsum && !validChecksum(buf[:numRead], tcp, remoteAddress, localAddress)) {
+			continue
+		}
+		if tcp.HasFlag(SYN) && tcp.HasFlag(ACK) {
+			reply.retransmits = append(reply.retransmits, time.Now())
+			logSegment(opts.Logger, tcp, buf[:numRead], "Retransmit from %s", raddr)
+		}
+	}
+	return reply, nil
+}
+
+// The read deadline must already be set on conn. It is passed in as well
+// because busy polling bypasses the runtime, which is what enforces it.
+// Also returns the TTL the packet arrived with, 0 if unknown.
+func readFrom(conn *net.IPConn, buf []byte, deadline time.Time, busyPoll bool) (int, net.Addr, int, error) {
+	if busyPoll {
+		return busyReadFrom(conn, buf, deadline)
+	}
+	return readFromTTL(conn, buf)
+}
+
+// Compares IPs rather than strings, because a link-local raddr will
+// have a zone, and the remote address might not.
+func fromAddr(raddr net.Addr, remoteIP net.IP) bool {
+	ipaddr, ok := raddr.(*net.IPAddr)
+	return ok && ipaddr != nil && ipaddr.IP.Equal(remoteIP)
+}
+
+func logf(logger *log.Logger, format string, args ...interface{}) {
+	if logger != nil {
+		logger.Printf(format, args...)
+	}
+}
+
+// A line saying what happened to the segment, with it decoded, then the
+// raw bytes on the next line
+func logSegment(logger *log.Logger, tcp *TCPHeader, data []byte, format string, args ...interface{}) {
+	if logger != nil {
+		logger.Printf("%s: %s\n  % x\n", fmt.Sprintf(format, args...), tcp, data)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Raw TCP socket network for the family of addr
+func tcpNetwork(addr string) string {
+	if isIPv6(addr) {
+		return tcp6Network
+	}
+	return tcp4Network
+}
+
+// Like net.ParseIP, but accepts a zone, as in fe80::1%eth0
+func parseIP(addr string) net.IP {
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	return net.ParseIP(addr)
+}
+
+func isIPv6(addr string) bool {
+	ip := parseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
+
+// Check that we can open the raw socket a probe from localAddr listens on,
+// so that a caller can fail at startup with an explanation for this OS
+// rather than mid-probe. A permission error wraps os.ErrPermission, for a
+// caller that would rather fall back to Options.Connect.
+func CheckRawSocket(localAddr string) error {
+	network := tcpNetwork(localAddr)
+	netaddr, err := net.ResolveIPAddr("ip", localAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenIP(network, netaddr)
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("Permission denied opening a raw socket: %w\n%s", err, permissionHint)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open raw %s socket on %s: %s\n%s", network, runtime.GOOS, err, rawSocketHint)
+	}
+	conn.Close()
+	return nil
+}
+
+// EPERM or EACCES opening a raw socket gets a hint at what to do about it.
+// It wraps err, so callers can still check for os.ErrPermission.
+func rawSocketError(op string, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%s: %w\n%s", op, err, permissionHint)
+	}
+	return fmt.Errorf("%s: %s", op, err)
+}
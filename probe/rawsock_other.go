@@ -0,0 +1,29 @@
+//go:build !linux && !darwin && !windows
+
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+// Network strings for net.Dial and net.ListenIP raw TCP sockets
+const (
+	tcp4Network = "ip4:tcp"
+	tcp6Network = "ip6:tcp"
+)
+
+const rawSocketHint = "Raw sockets usually require root."
+
+const permissionHint = "Raw sockets require root. Try sudo."
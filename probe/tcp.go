@@ -14,11 +14,13 @@ GNU General Public License for more details.
 For full license details see <http://www.gnu.org/licenses/>.
 */
 
-package main
+package probe
 
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"strings"
 )
 
 const (
@@ -30,6 +32,13 @@ const (
 	URG = 32 // 10 0000
 )
 
+// Option kinds, RFC 793
+const (
+	optionEnd = 0
+	optionNOP = 1
+	optionMSS = 2
+)
+
 type TCPHeader struct {
 	Source      uint16
 	Destination uint16
@@ -51,6 +60,25 @@ type TCPOption struct {
 	Data   []byte
 }
 
+// Maximum segment size option, as a normal client SYN has
+func mssOption(mss uint16) TCPOption {
+	return TCPOption{Kind: optionMSS, Length: 4, Data: []byte{byte(mss >> 8), byte(mss)}}
+}
+
+// Header length in bytes with the options, padded to a whole number of
+// 32-bit words, which is what DataOffset counts
+func (tcp *TCPHeader) headerLen() int {
+	length := 20
+	for _, option := range tcp.Options {
+		if option.Length > 1 {
+			length += int(option.Length)
+		} else {
+			length++
+		}
+	}
+	return (length + 3) &^ 3
+}
+
 // Parse packet into TCPHeader structure
 func NewTCPHeader(data []byte) *TCPHeader {
 	var tcp TCPHeader
@@ -78,6 +106,44 @@ func (tcp *TCPHeader) HasFlag(flagBit byte) bool {
 	return tcp.Ctrl&flagBit != 0
 }
 
+var flagNames = []struct {
+	bit  byte
+	name string
+}{{SYN, "SYN"}, {ACK, "ACK"}, {RST, "RST"}, {FIN, "FIN"}, {PSH, "PSH"}, {URG, "URG"}}
+
+// Like tcpdump: 80 > 51234 seq=1105024978 ack=2768443985 flags=SYN,ACK win=65535
+func (tcp *TCPHeader) String() string {
+	var flags []string
+	for _, flag := range flagNames {
+		if tcp.HasFlag(flag.bit) {
+			flags = append(flags, flag.name)
+		}
+	}
+	if len(flags) == 0 {
+		flags = append(flags, "none")
+	}
+	return fmt.Sprintf("%d > %d seq=%d ack=%d flags=%s win=%d",
+		tcp.Source, tcp.Destination, tcp.SeqNum, tcp.AckNum, strings.Join(flags, ","), tcp.Window)
+}
+
+// Whether this segment is the other end's answer to syn, whether that's
+// a SYN-ACK or a RST. Both acknowledge the SYN's sequence number.
+func (tcp *TCPHeader) isReplyTo(syn *TCPHeader) bool {
+	return tcp.mismatch(syn) == ""
+}
+
+// Why this segment isn't an answer to syn, or "" if it is
+func (tcp *TCPHeader) mismatch(syn *TCPHeader) string {
+	if tcp.Source != syn.Destination || tcp.Destination != syn.Source {
+		return fmt.Sprintf("wrong ports %d > %d, expected %d > %d",
+			tcp.Source, tcp.Destination, syn.Destination, syn.Source)
+	}
+	if tcp.AckNum != syn.SeqNum+1 {
+		return fmt.Sprintf("wrong ack %d, expected %d", tcp.AckNum, syn.SeqNum+1)
+	}
+	return ""
+}
+
 func (tcp *TCPHeader) Marshal() []byte {
 
 	buf := new(bytes.Buffer)
@@ -107,10 +173,11 @@ func (tcp *TCPHeader) Marshal() []byte {
 
 	out := buf.Bytes()
 
-	// Pad to min tcp header size, which is 20 bytes (5 32-bit words)
-	pad := 20 - len(out)
+	// Pad to min tcp header size, which is 20 bytes (5 32-bit words), or
+	// with options, to the next 32-bit word with End of Option List
+	pad := tcp.headerLen() - len(out)
 	for i := 0; i < pad; i++ {
-		out = append(out, 0)
+		out = append(out, optionEnd)
 	}
 
 	return out
@@ -122,15 +189,35 @@ func Csum(data []byte, srcip, dstip [4]byte) uint16 {
 	pseudoHeader := []byte{
 		srcip[0], srcip[1], srcip[2], srcip[3],
 		dstip[0], dstip[1], dstip[2], dstip[3],
-		0,                  // zero
-		6,                  // protocol number (6 == TCP)
-		0, byte(len(data)), // TCP length (16 bits), not inc pseudo header
+		0,                                     // zero
+		6,                                     // protocol number (6 == TCP)
+		byte(len(data) >> 8), byte(len(data)), // TCP length (16 bits), not inc pseudo header
 	}
 
+	return checksum(pseudoHeader, data)
+}
+
+// TCP Checksum over IPv6, which has a different pseudo header (RFC 2460)
+func Csum6(data []byte, srcip, dstip [16]byte) uint16 {
+
+	pseudoHeader := make([]byte, 0, 40)
+	pseudoHeader = append(pseudoHeader, srcip[:]...)
+	pseudoHeader = append(pseudoHeader, dstip[:]...)
+	pseudoHeader = append(pseudoHeader,
+		0, 0, byte(len(data)>>8), byte(len(data)), // TCP length (32 bits)
+		0, 0, 0, // zero
+		6, // next header (6 == TCP)
+	)
+
+	return checksum(pseudoHeader, data)
+}
+
+// Internet checksum (RFC 1071) of the pseudo header followed by the TCP data
+func checksum(pseudoHeader, data []byte) uint16 {
+
 	sumThis := make([]byte, 0, len(pseudoHeader)+len(data))
 	sumThis = append(sumThis, pseudoHeader...)
 	sumThis = append(sumThis, data...)
-	//fmt.Printf("% x\n", sumThis)
 
 	lenSumThis := len(sumThis)
 	var nextWord uint16
@@ -140,8 +227,8 @@ func Csum(data []byte, srcip, dstip [4]byte) uint16 {
 		sum += uint32(nextWord)
 	}
 	if lenSumThis%2 != 0 {
-		//fmt.Println("Odd byte")
-		sum += uint32(sumThis[len(sumThis)-1])
+		// The odd byte is the high half of a word padded with zero
+		sum += uint32(sumThis[len(sumThis)-1]) << 8
 	}
 
 	// Add back any carry, and any carry from adding the carry
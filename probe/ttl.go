@@ -0,0 +1,75 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package probe
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Sets the TTL, or hop limit for IPv6, of packets sent on conn
+func setTTL(conn net.Conn, ttl int, v6 bool) error {
+	if v6 {
+		return ipv6.NewConn(conn).SetHopLimit(ttl)
+	}
+	return ipv4.NewConn(conn).SetTTL(ttl)
+}
+
+// IPv4 raw sockets give us the IP header, and the TTL is in that, but
+// IPv6 ones never do, so the hop limit has to come as a control message.
+func enableHopLimit(conn *net.IPConn) error {
+	return ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagHopLimit, true)
+}
+
+// Like conn.ReadFrom, but also returns the TTL (hop limit for IPv6) the
+// packet arrived with, or 0 if that isn't known.
+func readFromTTL(conn *net.IPConn, buf []byte) (int, net.Addr, int, error) {
+	oob := make([]byte, 64)
+	numRead, oobn, _, raddr, err := conn.ReadMsgIP(buf, oob)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	numRead, ttl, err := packetTTL(buf, numRead, oob[:oobn], raddr != nil && raddr.IP.To4() != nil)
+	return numRead, raddr, ttl, err
+}
+
+// A raw IPv4 packet read with ReadMsgIP or recvmsg (unlike ReadFrom) still
+// has its IP header, so strip it off and take the TTL from it. For IPv6
+// the hop limit is in the control message, if there is one.
+// Returns the length of the TCP segment now at the start of buf.
+func packetTTL(buf []byte, numRead int, oob []byte, v4 bool) (int, int, error) {
+	if v4 {
+		if numRead < 20 {
+			return 0, 0, errors.New("short IPv4 packet")
+		}
+		ihl := int(buf[0]&0x0f) << 2
+		if numRead < ihl {
+			return 0, 0, errors.New("short IPv4 header")
+		}
+		ttl := int(buf[8])
+		return copy(buf, buf[ihl:numRead]), ttl, nil
+	}
+
+	var cm ipv6.ControlMessage
+	if err := cm.Parse(oob); err != nil {
+		return numRead, 0, nil
+	}
+	return numRead, cm.HopLimit, nil
+}
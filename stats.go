@@ -0,0 +1,122 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Summary of the probes to one host. Lost probes are counted in Sent but
+// are not part of the durations.
+type Stats struct {
+	Addr     string        // The address that was probed
+	Resolve  time.Duration // How long it took to resolve, once
+	Sent     int
+	Received int
+	Min      time.Duration
+	Max      time.Duration
+	Mean     time.Duration
+	Stddev   time.Duration
+	Jitter   time.Duration // See jitter
+	TTL      int           // Of the last reply, 0 if unknown
+	Open     bool          // The last reply was a SYN-ACK, not a RST
+
+	// Every RTT, in the order they arrived, for percentiles
+	Samples []time.Duration
+}
+
+func newStats(sent int, samples []time.Duration) Stats {
+	stats := Stats{Sent: sent, Received: len(samples), Samples: samples}
+	if len(samples) == 0 {
+		return stats
+	}
+
+	var sum float64
+	stats.Min, stats.Max = samples[0], samples[0]
+	for _, sample := range samples {
+		if sample < stats.Min {
+			stats.Min = sample
+		}
+		if sample > stats.Max {
+			stats.Max = sample
+		}
+		sum += float64(sample)
+	}
+	mean := sum / float64(len(samples))
+
+	var variance float64
+	for _, sample := range samples {
+		diff := float64(sample) - mean
+		variance += diff * diff
+	}
+	variance /= float64(len(samples))
+
+	stats.Mean = time.Duration(mean)
+	stats.Stddev = time.Duration(math.Sqrt(variance))
+	return stats
+}
+
+// Fraction of probes that got no reply, 0 to 1
+func (s Stats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Received) / float64(s.Sent)
+}
+
+// Like ping: min/avg/max/stddev = 12.100/14.800/31.200/5.300 ms, jitter = 2.100 ms
+func (s Stats) String() string {
+	return fmt.Sprintf("min/avg/max/stddev = %.3f/%.3f/%.3f/%.3f ms, jitter = %.3f ms",
+		ms(s.Min), ms(s.Mean), ms(s.Max), ms(s.Stddev), ms(s.Jitter))
+}
+
+// Mean absolute difference between the RTTs of consecutive probes. A lost
+// probe breaks the chain, so the probes either side of it aren't compared.
+type jitter struct {
+	prev     time.Duration // 0 at the start, or after a lost probe
+	sum      time.Duration
+	compared int
+}
+
+func (j *jitter) add(rtt time.Duration) {
+	if j.prev != 0 {
+		diff := rtt - j.prev
+		if diff < 0 {
+			diff = -diff
+		}
+		j.sum += diff
+		j.compared++
+	}
+	j.prev = rtt
+}
+
+func (j *jitter) lost() {
+	j.prev = 0
+}
+
+func (j *jitter) value() time.Duration {
+	if j.compared == 0 {
+		return 0
+	}
+	return j.sum / time.Duration(j.compared)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are batched into one datagram, a line each, up to this size. It
+// fits in a 1500 byte Ethernet MTU with room for the IPv6 and UDP headers.
+const statsdMaxPacket = 1432
+
+// How often a partly filled batch is sent, so that -t and -listen still
+// send every RTT promptly
+const statsdFlushInterval = time.Second
+
+// Sends measurements to a StatsD server, with DogStatsD style tags.
+// Targets are probed concurrently with -a and -f, so the batch is under a
+// lock. A nil *statsd is valid and sends nothing.
+type statsd struct {
+	conn net.Conn
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func newStatsd(addr string) (*statsd, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &statsd{conn: conn}
+	go func() {
+		for range time.NewTicker(statsdFlushInterval).C {
+			s.flush()
+		}
+	}()
+	return s, nil
+}
+
+// Send an RTT as latency.rtt:12.345|ms|#host:example.com
+func (s *statsd) timing(host string, rtt time.Duration) {
+	ms := float64(rtt) / float64(time.Millisecond)
+	s.send(fmt.Sprintf("latency.rtt:%.3f|ms|#host:%s", ms, statsdTag(host)))
+}
+
+// Count a probe that got no reply as latency.loss:1|c|#host:example.com
+func (s *statsd) lost(host string) {
+	s.send(fmt.Sprintf("latency.loss:1|c|#host:%s", statsdTag(host)))
+}
+
+// Adds metric to the batch, first sending the batch if it would be too big
+func (s *statsd) send(metric string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.buf) > 0 && len(s.buf)+1+len(metric) > statsdMaxPacket {
+		s.flushLocked()
+	}
+	if len(s.buf) > 0 {
+		s.buf = append(s.buf, '\n')
+	}
+	s.buf = append(s.buf, metric...)
+}
+
+// Sends the batch now. Called before exiting, as well as every
+// statsdFlushInterval.
+func (s *statsd) flush() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+}
+
+// Metrics are sent over UDP, so a failure to send is logged but does not
+// stop the probing.
+func (s *statsd) flushLocked() {
+	if len(s.buf) == 0 {
+		return
+	}
+	if _, err := s.conn.Write(s.buf); err != nil {
+		log.Println("statsd:", err)
+	}
+	s.buf = s.buf[:0]
+}
+
+// Characters that have a meaning in the StatsD line format
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "#", "_", ",", "_", " ", "_")
+
+func statsdTag(value string) string {
+	return statsdReplacer.Replace(strings.ToLower(value))
+}
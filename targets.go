@@ -0,0 +1,182 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+type target struct {
+	name string // What to call it in the output
+	host string
+	port uint16
+}
+
+type targetResult struct {
+	target
+	stats Stats
+	err   error
+}
+
+// Targets from a file with one host or host:port per line. Blank lines and
+// lines starting with # are skipped. A malformed line is reported with its
+// line number and skipped, only failing to read the file is an error.
+func readTargets(path string, defaultPort uint16) ([]target, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var targets []target
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		t, err := parseTarget(line, defaultPort)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, lineNum, err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets, scanner.Err()
+}
+
+// host, host:port, a bare IPv6 address, or [IPv6]:port
+func parseTarget(line string, defaultPort uint16) (target, error) {
+	if strings.ContainsAny(line, " \t") {
+		return target{}, fmt.Errorf("expected host or host:port, got %q", line)
+	}
+	if !strings.Contains(line, ":") || net.ParseIP(stripZone(line)) != nil {
+		return target{name: line, host: line, port: defaultPort}, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(line)
+	if err != nil {
+		return target{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return target{}, fmt.Errorf("invalid port %q", portStr)
+	}
+	return target{name: line, host: host, port: uint16(port)}, nil
+}
+
+// A comma separated list of ports and ranges, e.g. 80,443,8000-8010
+func parsePorts(list string) ([]uint16, error) {
+	var ports []uint16
+	for _, part := range strings.Split(list, ",") {
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		first, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil || first < 1 || first > 65535 {
+			return nil, fmt.Errorf("invalid port %q", from)
+		}
+		last, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || last < first || last > 65535 {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		for port := first; port <= last; port++ {
+			ports = append(ports, uint16(port))
+		}
+	}
+	return ports, nil
+}
+
+// Probes all the targets at once. The results are in the same order as
+// the targets.
+func measureTargets(localAddr string, targets []target, count int) []targetResult {
+	var wg sync.WaitGroup
+	results := make([]targetResult, len(targets))
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			stats, err := measure(localAddr, t.host, t.port, count)
+			results[i] = targetResult{t, stats, err}
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+// After the results are printed, exit if any of them failed, or are over
+// -max or -maxloss
+func checkResults(results []targetResult) {
+	var limits thresholds
+	for _, result := range results {
+		limits.check(result.name, result.stats, result.err)
+	}
+	limits.exit()
+}
+
+func printResultsJSON(results []targetResult) {
+	jsonResults := make([]Result, 0, len(results))
+	for _, result := range results {
+		jsonResults = append(jsonResults, newResult(result.host, result.port, result.stats, result.err))
+	}
+	printJSON(jsonResults)
+}
+
+// Measure the targets listed in path and print them as a table, in the
+// order they are in the file
+func fileTest(localAddr, path string, defaultPort uint16, count int) {
+	targets, err := readTargets(path, defaultPort)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	results := measureTargets(localAddr, targets, count)
+	defer checkResults(results)
+	if *csvParam {
+		return
+	}
+	if *jsonParam {
+		printResultsJSON(results)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tADDR\tPORT\tLATENCY\tLOSS")
+	for _, result := range results {
+		latency := result.stats.Mean.String()
+		if result.err != nil {
+			latency = result.err.Error()
+		}
+		// Nothing was sent if it didn't resolve, which isn't 0% loss
+		loss := "-"
+		if result.stats.Sent > 0 {
+			loss = fmt.Sprintf("%.0f%%", result.stats.Loss()*100)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
+			result.host, result.stats.Addr, result.port, latency, loss)
+	}
+	w.Flush()
+}
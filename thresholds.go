@@ -0,0 +1,77 @@
+/*
+Copyright 2013-2014 Graham King
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+For full license details see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Exit statuses for -max and -maxloss, for cron and Nagios style checks
+const (
+	exitLatency = 2
+	exitLoss    = 3
+)
+
+// Collects the worst result against -max and -maxloss across one or more
+// targets. Loss is the worse of the two, as a host that lost every probe
+// has no average to speak of. Either is worse than a measurement that
+// failed, which is exit status 1, as usual.
+type thresholds struct {
+	status int
+	failed bool
+}
+
+// Prints a one line reason if stats is over either limit. With -json or
+// -csv it goes to stderr, so that stdout can still be parsed.
+// err is the measurement's, which the caller has already reported.
+func (t *thresholds) check(name string, stats Stats, err error) {
+	if err != nil {
+		t.failed = true
+	}
+	status, reason := 0, ""
+	loss := stats.Loss() * 100
+	switch {
+	case stats.Sent > 0 && loss > *maxLossParam:
+		status = exitLoss
+		reason = fmt.Sprintf("%s: %.0f%% loss is over -maxloss %g%%", name, loss, *maxLossParam)
+	case *maxParam > 0 && stats.Received > 0 && stats.Mean > *maxParam:
+		status = exitLatency
+		reason = fmt.Sprintf("%s: average %v is over -max %v", name, stats.Mean, *maxParam)
+	default:
+		return
+	}
+
+	if textOutput() {
+		fmt.Println(reason)
+	} else {
+		fmt.Fprintln(os.Stderr, reason)
+	}
+	if status > t.status {
+		t.status = status
+	}
+}
+
+// Exits with the worst status, if anything was over a limit or failed
+func (t *thresholds) exit() {
+	if t.status != 0 {
+		exit(t.status)
+	}
+	if t.failed {
+		exit(1)
+	}
+}